@@ -20,6 +20,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"time"
@@ -32,6 +33,8 @@ import (
 	csiclient "k8s.io/csi-api/pkg/client/clientset/versioned"
 	csiinformers "k8s.io/csi-api/pkg/client/informers/externalversions"
 
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+
 	"github.com/dearcode/csi-lvm/pkg/attacher"
 )
 
@@ -48,17 +51,26 @@ const (
 
 // Command line flags
 var (
-	kubeconfig        = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
-	resync            = flag.Duration("resync", 10*time.Minute, "Resync interval of the attacher.")
-	connectionTimeout = flag.Duration("connection-timeout", 1*time.Minute, "Timeout for waiting for CSI driver socket.")
-	csiAddress        = flag.String("csi-address", "/run/csi/socket", "Address of the CSI driver socket.")
-	dummy             = flag.Bool("dummy", false, "Run in dummy mode, i.e. not connecting to CSI driver and marking everything as attached. Expected CSI driver name is \"csi/dummy\".")
-	showVersion       = flag.Bool("version", false, "Show version.")
-	timeout           = flag.Duration("timeout", 15*time.Second, "Timeout for waiting for attaching or detaching the volume.")
+	kubeconfig  = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
+	resync      = flag.Duration("resync", 10*time.Minute, "Resync interval of the attacher.")
+	csiAddress  = flag.String("csi-address", "/run/csi/socket", "Address of the CSI driver socket.")
+	dummy       = flag.Bool("dummy", false, "Run in dummy mode, i.e. not connecting to CSI driver and marking everything as attached. Expected CSI driver name is \"csi/dummy\".")
+	showVersion = flag.Bool("version", false, "Show version.")
+	timeout     = flag.Duration("timeout", 15*time.Second, "Timeout for waiting for attaching or detaching the volume.")
 
 	enableLeaderElection    = flag.Bool("leader-election", false, "Enable leader election.")
 	leaderElectionNamespace = flag.String("leader-election-namespace", "", "Namespace where this attacher runs.")
 	leaderElectionIdentity  = flag.String("leader-election-identity", "", "Unique idenity of this attcher. Typically name of the pod where the attacher runs.")
+
+	leaderElectionLeaseDuration = flag.Duration("leader-election-lease-duration", 15*time.Second, "Duration, in seconds, that non-leader candidates will wait to force acquire leadership.")
+	leaderElectionRenewDeadline = flag.Duration("leader-election-renew-deadline", 10*time.Second, "Duration, in seconds, that the acting leader will retry refreshing leadership before giving it up.")
+	leaderElectionRetryPeriod   = flag.Duration("leader-election-retry-period", 5*time.Second, "Duration, in seconds, the LeaderElector clients should wait between tries of actions.")
+
+	retryIntervalStart = flag.Duration("retry-interval-start", time.Second, "Initial retry interval of failed volume attach/detach operations. It doubles with each failure, up to retry-interval-max.")
+	retryIntervalMax   = flag.Duration("retry-interval-max", 5*time.Minute, "Maximum retry interval of failed volume attach/detach operations.")
+
+	metricsAddress = flag.String("metrics-address", "", "The TCP network address where the Prometheus metrics endpoint will listen, e.g. \":8080\". Disabled by default.")
+	metricsPath    = flag.String("metrics-path", "/metrics", "The HTTP path where Prometheus metrics will be exposed.")
 )
 
 var (
@@ -95,24 +107,31 @@ func main() {
 	}
 
 	factory := informers.NewSharedInformerFactory(clientset, *resync)
+	csiDriverInformer := factory.Storage().V1().CSIDrivers()
 	var csiFactory csiinformers.SharedInformerFactory
 	var handler attacher.Handler
 
+	metricsManager := attacher.NewMetricsManager("")
+
 	var attacherName string
 	if *dummy {
 		// Do not connect to any CSI, mark everything as attached.
 		handler = attacher.NewTrivialHandler(clientset)
 		attacherName = dummyAttacherName
 	} else {
-		// Connect to CSI.
-		csiConn, err := attacher.New(*csiAddress, *connectionTimeout)
+		// Connect to CSI. Connect blocks (logging progress) until the driver's
+		// socket is up; if the connection drops later, the process exits.
+		conn, err := attacher.Connect(*csiAddress, metricsManager)
 		if err != nil {
 			glog.Error(err.Error())
 			os.Exit(1)
 		}
 
-		// Check it's ready
-		if err = waitForDriverReady(csiConn, *connectionTimeout); err != nil {
+		// Block until the driver is ready to serve, rather than giving up
+		// after a fixed timeout. Each individual probe still times out
+		// after csiTimeout so a wedged driver doesn't hang the call
+		// forever.
+		if err := rpc.ProbeForever(conn, csiTimeout); err != nil {
 			glog.Error(err.Error())
 			os.Exit(1)
 		}
@@ -120,35 +139,55 @@ func main() {
 		// Find driver name.
 		ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
 		defer cancel()
-		attacherName, err = csiConn.GetDriverName(ctx)
+		attacherName, err = rpc.GetDriverName(ctx, conn)
 		if err != nil {
 			glog.Error(err.Error())
 			os.Exit(1)
 		}
 		glog.V(2).Infof("CSI driver name: %q", attacherName)
 
+		csiConn := attacher.NewCSIConnection(conn)
+
 		pvLister := factory.Core().V1().PersistentVolumes().Lister()
 		nodeLister := factory.Core().V1().Nodes().Lister()
 		vaLister := factory.Storage().V1beta1().VolumeAttachments().Lister()
 		csiFactory := csiinformers.NewSharedInformerFactory(csiClientset, *resync)
 		nodeInfoLister := csiFactory.Csi().V1alpha1().CSINodeInfos().Lister()
-		handler = attacher.NewCSIHandler(clientset, attacherName, csiConn, pvLister, nodeLister, nodeInfoLister, vaLister, timeout)
+		handler = attacher.NewCSIHandler(clientset, attacherName, csiConn, pvLister, nodeLister, nodeInfoLister, csiDriverInformer.Lister(), vaLister, timeout)
 		glog.V(2).Infof("CSI driver supports attacherPublishUnpublish, using real CSI handler")
 	}
 
+	metricsManager.SetDriverName(attacherName)
+
+	leaderHealthz := attacher.NewLeaderHealthz()
+	if !*enableLeaderElection {
+		// No leader election, so this process always acts as the leader.
+		leaderHealthz.SetLeading(true)
+	}
+
+	if *metricsAddress != "" {
+		mux := http.NewServeMux()
+		metricsManager.RegisterToServer(mux, *metricsPath)
+		if *enableLeaderElection {
+			mux.Handle("/healthz/leader-election", leaderHealthz)
+		}
+		go func() {
+			glog.Infof("Serving metrics on %s%s", *metricsAddress, *metricsPath)
+			if err := http.ListenAndServe(*metricsAddress, mux); err != nil {
+				glog.Errorf("metrics server failed: %v", err)
+			}
+		}()
+	}
+
 	if *enableLeaderElection {
-		// Leader election was requested.
-		if leaderElectionNamespace == nil || *leaderElectionNamespace == "" {
+		if *leaderElectionNamespace == "" {
 			glog.Error("-leader-election-namespace must not be empty")
 			os.Exit(1)
 		}
-		if leaderElectionIdentity == nil || *leaderElectionIdentity == "" {
+		if *leaderElectionIdentity == "" {
 			glog.Error("-leader-election-identity must not be empty")
 			os.Exit(1)
 		}
-		// Name of config map with leader election lock
-		lockName := "external-attacher-leader-" + attacherName
-		waitForLeader(clientset, *leaderElectionNamespace, *leaderElectionIdentity, lockName)
 	}
 
 	ctrl := attacher.NewCSIAttachController(
@@ -157,6 +196,9 @@ func main() {
 		handler,
 		factory.Storage().V1beta1().VolumeAttachments(),
 		factory.Core().V1().PersistentVolumes(),
+		csiDriverInformer,
+		*retryIntervalStart,
+		*retryIntervalMax,
 	)
 
 	// run...
@@ -165,11 +207,48 @@ func main() {
 	if csiFactory != nil {
 		csiFactory.Start(stopCh)
 	}
-	go ctrl.Run(threads, stopCh)
 
 	// ...until SIGINT
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
+
+	if *enableLeaderElection {
+		// Campaign for a coordination.k8s.io Lease. Only the holder runs the
+		// controller's workers; losing the lease closes stopCh so a stale
+		// replica stops acting rather than racing the new leader.
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-c
+			cancel()
+		}()
+
+		lockName := "external-attacher-leader-" + attacherName
+		cfg := attacher.LeaderElectionConfig{
+			Namespace:     *leaderElectionNamespace,
+			Identity:      *leaderElectionIdentity,
+			LockName:      lockName,
+			LeaseDuration: *leaderElectionLeaseDuration,
+			RenewDeadline: *leaderElectionRenewDeadline,
+			RetryPeriod:   *leaderElectionRetryPeriod,
+		}
+		err := attacher.RunLeaderElection(ctx, clientset, cfg,
+			func(ctx context.Context) {
+				leaderHealthz.SetLeading(true)
+				ctrl.Run(threads, stopCh)
+			},
+			func() {
+				leaderHealthz.SetLeading(false)
+				close(stopCh)
+			},
+		)
+		if err != nil {
+			glog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	go ctrl.Run(threads, stopCh)
 	<-c
 	close(stopCh)
 }
@@ -180,25 +259,3 @@ func buildConfig(kubeconfig string) (*rest.Config, error) {
 	}
 	return rest.InClusterConfig()
 }
-
-func waitForDriverReady(csiConn attacher.CSIConnection, timeout time.Duration) error {
-	now := time.Now()
-	finish := now.Add(timeout)
-	var err error
-	for {
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		err = csiConn.Probe(ctx)
-		if err == nil {
-			glog.V(2).Infof("Probe succeeded")
-			return nil
-		}
-		glog.V(2).Infof("Probe failed with %s", err)
-
-		now := time.Now()
-		if now.After(finish) {
-			return fmt.Errorf("Failed to probe the attacher: %s", err)
-		}
-		time.Sleep(time.Second)
-	}
-}
@@ -0,0 +1,71 @@
+// Package v1alpha1 contains the minimal set of VolumeGroupSnapshot API
+// types needed by the CSI provisioner to restore a PVC from a member of a
+// group snapshot. It mirrors the shape of the upstream
+// groupsnapshot.storage.k8s.io CRDs closely enough to decode them, without
+// pulling in the full generated client used by the single-volume
+// VolumeSnapshot API.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// GroupName is the API group of the VolumeGroupSnapshot CRDs.
+	GroupName = "groupsnapshot.storage.k8s.io"
+
+	// VolumeGroupSnapshotKind is the DataSource.Kind a PVC uses to restore
+	// a single member volume out of a group snapshot.
+	VolumeGroupSnapshotKind = "VolumeGroupSnapshot"
+)
+
+// VolumeGroupSnapshot represents a point-in-time, crash-consistent snapshot
+// taken across a set of PersistentVolumeClaims.
+type VolumeGroupSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeGroupSnapshotSpec   `json:"spec"`
+	Status VolumeGroupSnapshotStatus `json:"status,omitempty"`
+}
+
+// VolumeGroupSnapshotList is a list of VolumeGroupSnapshot objects.
+type VolumeGroupSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []VolumeGroupSnapshot `json:"items"`
+}
+
+// VolumeGroupSnapshotSpec is the desired state of a VolumeGroupSnapshot.
+type VolumeGroupSnapshotSpec struct {
+	// PersistentVolumeClaimNames lists the PVCs that make up the group.
+	PersistentVolumeClaimNames []string `json:"persistentVolumeClaimNames"`
+}
+
+// VolumeGroupSnapshotStatus is the observed state of a VolumeGroupSnapshot.
+type VolumeGroupSnapshotStatus struct {
+	ReadyToUse bool `json:"readyToUse,omitempty"`
+
+	// Members is the per-PVC result of the group snapshot, one entry per
+	// PVC named in Spec.PersistentVolumeClaimNames.
+	Members []PVPVCMapping `json:"members,omitempty"`
+}
+
+// PVPVCMapping pairs the PVC that was a member of the group with the
+// VolumeSnapshot/VolumeSnapshotContent pair that was created for its
+// backing PV, so that a restore consumer can validate the
+// VolumeSnapshotContent is actually bound to the VolumeSnapshot this
+// mapping says it belongs to, the same way a direct VolumeSnapshot restore
+// validates its VolumeSnapshotContent.
+type PVPVCMapping struct {
+	PersistentVolumeClaimName string `json:"persistentVolumeClaimName"`
+	PersistentVolumeName      string `json:"persistentVolumeName"`
+
+	VolumeSnapshotName      string    `json:"volumeSnapshotName"`
+	VolumeSnapshotNamespace string    `json:"volumeSnapshotNamespace"`
+	VolumeSnapshotUID       types.UID `json:"volumeSnapshotUID"`
+
+	VolumeSnapshotContentName string `json:"volumeSnapshotContentName"`
+}
@@ -0,0 +1,123 @@
+package attacher
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
+	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+// CSIConnection is a thin wrapper around a CSI driver's gRPC endpoint,
+// exposing only the controller RPCs the attach controller needs.
+type CSIConnection interface {
+	// Attach issues ControllerPublishVolume and returns the resulting
+	// publish context to store on the VolumeAttachment status.
+	Attach(ctx context.Context, volumeID, nodeID string, caps *csi.VolumeCapability, readOnly bool, secrets, volumeContext map[string]string) (map[string]string, error)
+
+	// Detach issues ControllerUnpublishVolume.
+	Detach(ctx context.Context, volumeID, nodeID string, secrets map[string]string) error
+
+	// GetDriverName returns the CSI driver's name, as reported by
+	// GetPluginInfo.
+	GetDriverName(ctx context.Context) (string, error)
+
+	// SupportsControllerPublish reports whether the driver advertises the
+	// PUBLISH_UNPUBLISH_VOLUME controller capability.
+	SupportsControllerPublish(ctx context.Context) (bool, error)
+
+	// Probe calls the identity service's Probe RPC.
+	Probe(ctx context.Context) error
+}
+
+type csiConnection struct {
+	conn *grpc.ClientConn
+}
+
+// Connect dials the CSI driver listening on the given unix socket address
+// using csi-lib-utils/connection, which retries indefinitely (logging
+// progress) rather than failing after a fixed timeout. If an established
+// connection is lost, the process exits instead of reconnecting. Every RPC made over the returned
+// connection is recorded on mm via a gRPC unary interceptor, so metrics stay
+// uniform regardless of which method on CSIConnection issued the call.
+func Connect(address string, mm metrics.CSIMetricsManager) (*grpc.ClientConn, error) {
+	return connection.Connect(address, mm, connection.OnConnectionLoss(connection.ExitOnConnectionLoss()))
+}
+
+// NewCSIConnection wraps an already-established gRPC connection to a CSI
+// driver as a CSIConnection.
+func NewCSIConnection(conn *grpc.ClientConn) CSIConnection {
+	return &csiConnection{conn: conn}
+}
+
+func (c *csiConnection) GetDriverName(ctx context.Context) (string, error) {
+	client := csi.NewIdentityClient(c.conn)
+	rep, err := client.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		return "", err
+	}
+	if rep.GetName() == "" {
+		return "", fmt.Errorf("driver returned an empty name")
+	}
+	return rep.GetName(), nil
+}
+
+func (c *csiConnection) Probe(ctx context.Context) error {
+	client := csi.NewIdentityClient(c.conn)
+	_, err := client.Probe(ctx, &csi.ProbeRequest{})
+	return err
+}
+
+func (c *csiConnection) SupportsControllerPublish(ctx context.Context) (bool, error) {
+	client := csi.NewControllerClient(c.conn)
+	rep, err := client.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		return false, err
+	}
+	for _, cap := range rep.GetCapabilities() {
+		if rpc := cap.GetRpc(); rpc != nil && rpc.GetType() == csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *csiConnection) Attach(ctx context.Context, volumeID, nodeID string, caps *csi.VolumeCapability, readOnly bool, secrets, volumeContext map[string]string) (map[string]string, error) {
+	client := csi.NewControllerClient(c.conn)
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:                 volumeID,
+		NodeId:                   nodeID,
+		VolumeCapability:         caps,
+		Readonly:                 readOnly,
+		ControllerPublishSecrets: secrets,
+		VolumeAttributes:         volumeContext,
+	}
+	rep, err := client.ControllerPublishVolume(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.GetPublishInfo(), nil
+}
+
+func (c *csiConnection) Detach(ctx context.Context, volumeID, nodeID string, secrets map[string]string) error {
+	client := csi.NewControllerClient(c.conn)
+	req := &csi.ControllerUnpublishVolumeRequest{
+		VolumeId:                   volumeID,
+		NodeId:                     nodeID,
+		ControllerUnpublishSecrets: secrets,
+	}
+	_, err := client.ControllerUnpublishVolume(ctx, req)
+	if err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package attacher
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	storagev1informers "k8s.io/client-go/informers/storage/v1"
+	storageinformers "k8s.io/client-go/informers/storage/v1beta1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	workqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "csi_sidecar_workqueue_depth",
+		Help: "Number of items waiting in the attach controller's workqueues.",
+	}, []string{"queue"})
+	workqueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "csi_sidecar_workqueue_retries_total",
+		Help: "Number of times an item was requeued after a failed sync.",
+	}, []string{"queue"})
+)
+
+func init() {
+	prometheus.MustRegister(workqueueDepth, workqueueRetries)
+}
+
+// CSIAttachController watches VolumeAttachment and PersistentVolume objects
+// and drives Handler.Attach/Detach to bring the cluster's attachment state
+// in line with what's requested.
+type CSIAttachController struct {
+	client       kubernetes.Interface
+	attacherName string
+	handler      Handler
+
+	vaLister        storageListerSynced
+	pvLister        coreListerSynced
+	csiDriverLister storagev1informers.CSIDriverInformer
+	vaQueue         workqueue.RateLimitingInterface
+	pvQueue         workqueue.RateLimitingInterface
+}
+
+type storageListerSynced struct {
+	informer storageinformers.VolumeAttachmentInformer
+}
+
+type coreListerSynced struct {
+	informer coreinformers.PersistentVolumeInformer
+}
+
+// NewCSIAttachController creates a new CSIAttachController. retryIntervalStart
+// and retryIntervalMax bound the exponential backoff applied to both the PV
+// and VolumeAttachment workqueues: a failed sync is requeued with
+// AddRateLimited, doubling the delay up to retryIntervalMax, and a
+// successful sync calls Forget to reset it.
+func NewCSIAttachController(
+	client kubernetes.Interface,
+	attacherName string,
+	handler Handler,
+	vaInformer storageinformers.VolumeAttachmentInformer,
+	pvInformer coreinformers.PersistentVolumeInformer,
+	csiDriverInformer storagev1informers.CSIDriverInformer,
+	retryIntervalStart time.Duration,
+	retryIntervalMax time.Duration,
+) *CSIAttachController {
+	ctrl := &CSIAttachController{
+		client:          client,
+		attacherName:    attacherName,
+		handler:         handler,
+		vaLister:        storageListerSynced{informer: vaInformer},
+		pvLister:        coreListerSynced{informer: pvInformer},
+		csiDriverLister: csiDriverInformer,
+		vaQueue:         workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(retryIntervalStart, retryIntervalMax), "csi-attacher-va"),
+		pvQueue:         workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(retryIntervalStart, retryIntervalMax), "csi-attacher-pv"),
+	}
+
+	vaInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.enqueueVA,
+		UpdateFunc: func(old, new interface{}) { ctrl.enqueueVA(new) },
+		DeleteFunc: ctrl.enqueueVA,
+	})
+	pvInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.enqueuePV,
+		UpdateFunc: func(old, new interface{}) { ctrl.enqueuePV(new) },
+	})
+	csiDriverInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.enqueueVAsForCSIDriver,
+		UpdateFunc: func(old, new interface{}) { ctrl.enqueueVAsForCSIDriver(new) },
+	})
+
+	return ctrl
+}
+
+func (ctrl *CSIAttachController) enqueueVA(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("failed to get key for VolumeAttachment: %v", err)
+		return
+	}
+	ctrl.vaQueue.Add(key)
+}
+
+func (ctrl *CSIAttachController) enqueuePV(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("failed to get key for PersistentVolume: %v", err)
+		return
+	}
+	ctrl.pvQueue.Add(key)
+}
+
+// enqueueVAsForCSIDriver re-syncs every VolumeAttachment for this attacher
+// when its CSIDriver object changes, so a flip of spec.attachRequired is
+// picked up without waiting for the next VolumeAttachment event.
+func (ctrl *CSIAttachController) enqueueVAsForCSIDriver(obj interface{}) {
+	vas, err := ctrl.vaLister.informer.Lister().List(labels.Everything())
+	if err != nil {
+		glog.Errorf("failed to list VolumeAttachments to re-sync after CSIDriver change: %v", err)
+		return
+	}
+	for _, va := range vas {
+		if va.Spec.Attacher != ctrl.attacherName {
+			continue
+		}
+		ctrl.enqueueVA(va)
+	}
+}
+
+// Run starts threads worker goroutines processing the VolumeAttachment and
+// PersistentVolume workqueues, until stopCh is closed.
+func (ctrl *CSIAttachController) Run(threads int, stopCh <-chan struct{}) {
+	defer ctrl.vaQueue.ShutDown()
+	defer ctrl.pvQueue.ShutDown()
+
+	glog.Infof("Starting CSI attacher for driver %s", ctrl.attacherName)
+	defer glog.Infof("Shutting down CSI attacher for driver %s", ctrl.attacherName)
+
+	if !cache.WaitForCacheSync(stopCh, ctrl.vaLister.informer.Informer().HasSynced, ctrl.pvLister.informer.Informer().HasSynced, ctrl.csiDriverLister.Informer().HasSynced) {
+		return
+	}
+
+	for i := 0; i < threads; i++ {
+		go wait.Until(ctrl.vaWorker, time.Second, stopCh)
+		go wait.Until(ctrl.pvWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+}
+
+func (ctrl *CSIAttachController) vaWorker() {
+	for ctrl.processNextVA() {
+	}
+}
+
+func (ctrl *CSIAttachController) pvWorker() {
+	for ctrl.processNextPV() {
+	}
+}
+
+func (ctrl *CSIAttachController) processNextVA() bool {
+	key, shutdown := ctrl.vaQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer ctrl.vaQueue.Done(key)
+	workqueueDepth.WithLabelValues("va").Set(float64(ctrl.vaQueue.Len()))
+
+	if err := ctrl.syncVA(key.(string)); err != nil {
+		glog.Warningf("error syncing VolumeAttachment %q, will retry: %v", key, err)
+		workqueueRetries.WithLabelValues("va").Inc()
+		ctrl.vaQueue.AddRateLimited(key)
+		return true
+	}
+	ctrl.vaQueue.Forget(key)
+	return true
+}
+
+func (ctrl *CSIAttachController) processNextPV() bool {
+	key, shutdown := ctrl.pvQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer ctrl.pvQueue.Done(key)
+	workqueueDepth.WithLabelValues("pv").Set(float64(ctrl.pvQueue.Len()))
+
+	if err := ctrl.syncPV(key.(string)); err != nil {
+		glog.Warningf("error syncing PersistentVolume %q, will retry: %v", key, err)
+		workqueueRetries.WithLabelValues("pv").Inc()
+		ctrl.pvQueue.AddRateLimited(key)
+		return true
+	}
+	ctrl.pvQueue.Forget(key)
+	return true
+}
+
+func (ctrl *CSIAttachController) syncVA(key string) error {
+	_, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	va, err := ctrl.vaLister.informer.Lister().Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if va.Spec.Attacher != ctrl.attacherName {
+		return nil
+	}
+
+	if va.Spec.Source.PersistentVolumeName == nil {
+		glog.V(4).Infof("VolumeAttachment %s has no PV source, ignoring", va.Name)
+		return nil
+	}
+
+	pv, err := ctrl.pvLister.informer.Lister().Get(*va.Spec.Source.PersistentVolumeName)
+	if err != nil {
+		return err
+	}
+
+	node, err := ctrl.client.CoreV1().Nodes().Get(va.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if va.DeletionTimestamp != nil {
+		if err := ctrl.handler.Detach(pv, node); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if va.Status.Attached {
+		return nil
+	}
+
+	publishInfo, err := ctrl.handler.Attach(pv, node)
+	if err != nil {
+		return err
+	}
+
+	va = va.DeepCopy()
+	va.Status.Attached = true
+	va.Status.AttachmentMetadata = publishInfo
+	_, err = ctrl.client.StorageV1beta1().VolumeAttachments().UpdateStatus(va)
+	return err
+}
+
+func (ctrl *CSIAttachController) syncPV(key string) error {
+	_, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := ctrl.pvLister.informer.Lister().Get(name); errors.IsNotFound(err) {
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package attacher
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// TestRateLimiterDelaysGrow verifies the exponential backoff parameters used
+// by NewCSIAttachController double the requeue delay on repeated failures,
+// up to the configured max.
+func TestRateLimiterDelaysGrow(t *testing.T) {
+	start := 1 * time.Second
+	max := 16 * time.Second
+	limiter := workqueue.NewItemExponentialFailureRateLimiter(start, max)
+
+	item := "default/pv-1"
+	want := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 16 * time.Second}
+	for i, expected := range want {
+		got := limiter.When(item)
+		if got != expected {
+			t.Errorf("attempt %d: got delay %v, want %v", i, got, expected)
+		}
+	}
+}
+
+// TestRateLimitersAreIndependentPerQueue verifies that two rate limiters
+// built the way NewCSIAttachController builds one per workqueue keep
+// separate failure counts, so a VolumeAttachment and a PersistentVolume
+// sharing the same name string don't share a backoff counter.
+func TestRateLimitersAreIndependentPerQueue(t *testing.T) {
+	start := 1 * time.Second
+	max := 16 * time.Second
+
+	vaLimiter := workqueue.NewItemExponentialFailureRateLimiter(start, max)
+	pvLimiter := workqueue.NewItemExponentialFailureRateLimiter(start, max)
+
+	sameName := "default/my-volume"
+
+	// Drive the VA limiter's failure count up.
+	vaLimiter.When(sameName)
+	vaLimiter.When(sameName)
+	vaDelay := vaLimiter.When(sameName)
+
+	// The PV limiter has never seen this key, so it should still be at the
+	// initial delay, independent of the VA limiter's state.
+	pvDelay := pvLimiter.When(sameName)
+
+	if pvDelay != start {
+		t.Errorf("expected independent PV rate limiter to start at %v, got %v (VA limiter was at %v)", start, pvDelay, vaDelay)
+	}
+}
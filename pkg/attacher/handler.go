@@ -0,0 +1,178 @@
+package attacher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	csilisters "k8s.io/csi-api/pkg/client/listers/csi/v1alpha1"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Handler attaches and detaches volumes named by VolumeAttachment objects.
+// It is implemented once per attach mode: the trivial handler used for
+// -dummy, and the real CSI handler that talks to a driver.
+type Handler interface {
+	Init(*v1.PersistentVolume, *v1.Node) error
+	Attach(*v1.PersistentVolume, *v1.Node) (map[string]string, error)
+	Detach(*v1.PersistentVolume, *v1.Node) error
+}
+
+// trivialHandler marks every VolumeAttachment as attached without talking
+// to any CSI driver. Used when the sidecar is run with -dummy.
+type trivialHandler struct {
+	client kubernetes.Interface
+}
+
+// NewTrivialHandler creates a Handler that immediately succeeds every
+// attach/detach, used for testing the rest of the attach controller
+// without a real CSI driver.
+func NewTrivialHandler(client kubernetes.Interface) Handler {
+	return &trivialHandler{client: client}
+}
+
+func (h *trivialHandler) Init(pv *v1.PersistentVolume, node *v1.Node) error {
+	return nil
+}
+
+func (h *trivialHandler) Attach(pv *v1.PersistentVolume, node *v1.Node) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (h *trivialHandler) Detach(pv *v1.PersistentVolume, node *v1.Node) error {
+	return nil
+}
+
+// csiHandler attaches and detaches volumes by issuing
+// ControllerPublishVolume/ControllerUnpublishVolume to the CSI driver
+// listening on csiConnection.
+type csiHandler struct {
+	client          kubernetes.Interface
+	attacherName    string
+	csiConnection   CSIConnection
+	pvLister        corelisters.PersistentVolumeLister
+	nodeLister      corelisters.NodeLister
+	nodeInfoLister  csilisters.CSINodeInfoLister
+	csiDriverLister storagev1listers.CSIDriverLister
+	vaLister        storagelisters.VolumeAttachmentLister
+	timeout         *time.Duration
+}
+
+// NewCSIHandler creates a Handler that attaches/detaches volumes through
+// csiConnection. If the driver's CSIDriver object sets
+// spec.attachRequired=false, Attach/Detach skip the CSI RPC entirely and
+// behave like the trivial handler for that driver.
+func NewCSIHandler(
+	client kubernetes.Interface,
+	attacherName string,
+	csiConnection CSIConnection,
+	pvLister corelisters.PersistentVolumeLister,
+	nodeLister corelisters.NodeLister,
+	nodeInfoLister csilisters.CSINodeInfoLister,
+	csiDriverLister storagev1listers.CSIDriverLister,
+	vaLister storagelisters.VolumeAttachmentLister,
+	timeout *time.Duration,
+) Handler {
+	return &csiHandler{
+		client:          client,
+		attacherName:    attacherName,
+		csiConnection:   csiConnection,
+		pvLister:        pvLister,
+		nodeLister:      nodeLister,
+		nodeInfoLister:  nodeInfoLister,
+		csiDriverLister: csiDriverLister,
+		vaLister:        vaLister,
+		timeout:         timeout,
+	}
+}
+
+func (h *csiHandler) Init(pv *v1.PersistentVolume, node *v1.Node) error {
+	return nil
+}
+
+// attachRequired reports whether h.attacherName's CSIDriver object requests
+// attach/detach handling. Drivers with no CSIDriver object, or one that
+// leaves spec.attachRequired unset, default to true for backwards
+// compatibility with drivers that pre-date CSIDriver registration.
+func (h *csiHandler) attachRequired() bool {
+	driver, err := h.csiDriverLister.Get(h.attacherName)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			glog.Warningf("failed to get CSIDriver %s, assuming attach is required: %v", h.attacherName, err)
+		}
+		return true
+	}
+	if driver.Spec.AttachRequired == nil {
+		return true
+	}
+	return *driver.Spec.AttachRequired
+}
+
+func (h *csiHandler) Attach(pv *v1.PersistentVolume, node *v1.Node) (map[string]string, error) {
+	if pv.Spec.CSI == nil {
+		return nil, fmt.Errorf("PV %s is not a CSI volume", pv.Name)
+	}
+
+	if !h.attachRequired() {
+		glog.V(4).Infof("CSIDriver %s has attachRequired=false, marking volume %s attached without a CSI call", h.attacherName, pv.Spec.CSI.VolumeHandle)
+		return map[string]string{}, nil
+	}
+
+	nodeID, err := nodeIDFromNode(node, h.attacherName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *h.timeout)
+	defer cancel()
+
+	caps := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+
+	glog.V(4).Infof("Attaching volume %s to node %s", pv.Spec.CSI.VolumeHandle, nodeID)
+	return h.csiConnection.Attach(ctx, pv.Spec.CSI.VolumeHandle, nodeID, caps, false, nil, pv.Spec.CSI.VolumeAttributes)
+}
+
+func (h *csiHandler) Detach(pv *v1.PersistentVolume, node *v1.Node) error {
+	if pv.Spec.CSI == nil {
+		return fmt.Errorf("PV %s is not a CSI volume", pv.Name)
+	}
+
+	if !h.attachRequired() {
+		glog.V(4).Infof("CSIDriver %s has attachRequired=false, skipping detach of volume %s", h.attacherName, pv.Spec.CSI.VolumeHandle)
+		return nil
+	}
+
+	nodeID, err := nodeIDFromNode(node, h.attacherName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *h.timeout)
+	defer cancel()
+
+	glog.V(4).Infof("Detaching volume %s from node %s", pv.Spec.CSI.VolumeHandle, nodeID)
+	return h.csiConnection.Detach(ctx, pv.Spec.CSI.VolumeHandle, nodeID, nil)
+}
+
+// nodeIDFromNode extracts the driver's node ID from the
+// csi.volume.kubernetes.io/nodeid annotation set by the node plugin.
+func nodeIDFromNode(node *v1.Node, driverName string) (string, error) {
+	nodeID, ok := node.Annotations["csi.volume.kubernetes.io/nodeid"]
+	if !ok {
+		return "", fmt.Errorf("node %s has no CSI node ID annotation", node.Name)
+	}
+	return nodeID, nil
+}
@@ -0,0 +1,38 @@
+package attacher
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// LeaderHealthz serves a /healthz/leader-election endpoint that only
+// answers healthy while this process holds the leader election lease, so a
+// readiness probe can steer traffic away from standby replicas.
+type LeaderHealthz struct {
+	leading int32
+}
+
+// NewLeaderHealthz creates a LeaderHealthz that reports unhealthy until
+// SetLeading(true) is called.
+func NewLeaderHealthz() *LeaderHealthz {
+	return &LeaderHealthz{}
+}
+
+// SetLeading records whether this process currently holds the lease.
+func (h *LeaderHealthz) SetLeading(leading bool) {
+	v := int32(0)
+	if leading {
+		v = 1
+	}
+	atomic.StoreInt32(&h.leading, v)
+}
+
+func (h *LeaderHealthz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.leading) == 1 {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("not leader"))
+}
@@ -0,0 +1,70 @@
+package attacher
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+// LeaderElectionConfig bundles the tunables for RunLeaderElection.
+type LeaderElectionConfig struct {
+	Namespace     string
+	Identity      string
+	LockName      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// RunLeaderElection campaigns for leadership using a coordination.k8s.io
+// Lease named cfg.LockName, rather than the ConfigMap lock previously used,
+// so the sidecar works on clusters where it only has RBAC for Leases.
+// onStartedLeading is called once this identity acquires the lease, and
+// onStoppedLeading once it is lost, so the caller can stop processing
+// rather than act on stale state. RunLeaderElection blocks until the lease
+// is lost or ctx is cancelled, emitting Events on namespace cfg.Namespace
+// to record leader transitions.
+func RunLeaderElection(ctx context.Context, client kubernetes.Interface, cfg LeaderElectionConfig, onStartedLeading func(context.Context), onStoppedLeading func()) error {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(cfg.Namespace)})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: cfg.Identity})
+
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		cfg.Namespace,
+		cfg.LockName,
+		client.CoreV1(),
+		client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity:      cfg.Identity,
+			EventRecorder: recorder,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: cfg.LeaseDuration,
+		RenewDeadline: cfg.RenewDeadline,
+		RetryPeriod:   cfg.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: onStartedLeading,
+			OnStoppedLeading: func() {
+				glog.Infof("%s lost leadership of %s/%s, stepping down", cfg.Identity, cfg.Namespace, cfg.LockName)
+				onStoppedLeading()
+			},
+		},
+	})
+	return nil
+}
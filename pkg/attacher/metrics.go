@@ -0,0 +1,13 @@
+package attacher
+
+import (
+	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+)
+
+// NewMetricsManager creates a CSIMetricsManager for driverName. It is passed
+// to Connect so that every outgoing CSI gRPC call is recorded as
+// csi_sidecar_operations_seconds{driver_name, method_name, grpc_status_code},
+// and registered on the metrics HTTP server set up by cmd/attacher.
+func NewMetricsManager(driverName string) metrics.CSIMetricsManager {
+	return metrics.NewCSIMetricsManager(driverName)
+}
@@ -0,0 +1,100 @@
+// Package groupsnapshot is a small hand-written typed client for the
+// VolumeGroupSnapshot CRDs, following the same shape as the generated
+// clientsets used elsewhere in this repository (e.g. snapclientset) but
+// written by hand since no codegen is wired up for this API group yet.
+package groupsnapshot
+
+import (
+	groupsnapshotapi "github.com/dearcode/csi-lvm/pkg/apis/groupsnapshot/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// SchemeGroupVersion is the group version used to register these types.
+var SchemeGroupVersion = schema.GroupVersion{Group: groupsnapshotapi.GroupName, Version: "v1alpha1"}
+
+func addToScheme(s *runtime.Scheme) error {
+	s.AddKnownTypes(SchemeGroupVersion,
+		&groupsnapshotapi.VolumeGroupSnapshot{},
+		&groupsnapshotapi.VolumeGroupSnapshotList{},
+	)
+	metav1.AddToGroupVersion(s, SchemeGroupVersion)
+	return nil
+}
+
+// Interface is the subset of the VolumeGroupSnapshot API this provisioner
+// needs.
+type Interface interface {
+	GroupsnapshotV1alpha1() V1alpha1Interface
+}
+
+// V1alpha1Interface exposes the v1alpha1 resources of this API group.
+type V1alpha1Interface interface {
+	VolumeGroupSnapshots(namespace string) VolumeGroupSnapshotInterface
+}
+
+// VolumeGroupSnapshotInterface has methods to work with VolumeGroupSnapshot resources.
+type VolumeGroupSnapshotInterface interface {
+	Get(name string, options metav1.GetOptions) (*groupsnapshotapi.VolumeGroupSnapshot, error)
+}
+
+// Clientset implements Interface using a plain REST client.
+type Clientset struct {
+	client rest.Interface
+}
+
+// NewForConfig creates a new Clientset for the given config.
+func NewForConfig(c *rest.Config) (*Clientset, error) {
+	config := *c
+	s := runtime.NewScheme()
+	if err := addToScheme(s); err != nil {
+		return nil, err
+	}
+	config.GroupVersion = &SchemeGroupVersion
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = serializer.NewCodecFactory(s).WithoutConversion()
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+
+	client, err := rest.RESTClientFor(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &Clientset{client: client}, nil
+}
+
+// GroupsnapshotV1alpha1 returns the v1alpha1 group client.
+func (c *Clientset) GroupsnapshotV1alpha1() V1alpha1Interface {
+	return &v1alpha1Client{client: c.client}
+}
+
+type v1alpha1Client struct {
+	client rest.Interface
+}
+
+func (c *v1alpha1Client) VolumeGroupSnapshots(namespace string) VolumeGroupSnapshotInterface {
+	return &volumeGroupSnapshots{client: c.client, ns: namespace}
+}
+
+type volumeGroupSnapshots struct {
+	client rest.Interface
+	ns     string
+}
+
+func (c *volumeGroupSnapshots) Get(name string, options metav1.GetOptions) (*groupsnapshotapi.VolumeGroupSnapshot, error) {
+	result := &groupsnapshotapi.VolumeGroupSnapshot{}
+	err := c.client.Get().
+		Namespace(c.ns).
+		Resource("volumegroupsnapshots").
+		Name(name).
+		VersionedParams(&options, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+const (
+	pvcKind = "PersistentVolumeClaim"
+)
+
+// SupportsControllerClone probes the CSI driver's advertised controller
+// capabilities and reports whether it supports the CLONE_VOLUME RPC. It is
+// called once at provisioner startup and the result cached on
+// csiProvisioner, mirroring how the driver identity is resolved once up
+// front rather than on every Provision call.
+func SupportsControllerClone(csiClient csi.ControllerClient, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rep, err := csiClient.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		return false, err
+	}
+
+	for _, cap := range rep.GetCapabilities() {
+		if rpc := cap.GetRpc(); rpc != nil && rpc.GetType() == csi.ControllerServiceCapability_RPC_CLONE_VOLUME {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getVolumeContentSourceFromPVC resolves the CSI volume id to clone from
+// when options.PVC.Spec.DataSource references another PersistentVolumeClaim
+// in the same namespace. It mirrors the validation getVolumeContentSource
+// does for a snapshot source: the source must be Bound, backed by this
+// provisioner's driver, and no larger than the requested capacity.
+func (p *csiProvisioner) getVolumeContentSourceFromPVC(options controller.VolumeOptions) (*csi.VolumeContentSource, error) {
+	if !utilfeature.DefaultFeatureGate.Enabled(features.VolumeCloning) {
+		return nil, fmt.Errorf("volume cloning requested but the %s feature gate is not enabled", features.VolumeCloning)
+	}
+	if !p.supportsClone {
+		return nil, fmt.Errorf("CSI driver %s does not advertise the CLONE_VOLUME controller capability", DriverName)
+	}
+
+	sourcePVCName := options.PVC.Spec.DataSource.Name
+	sourcePVC, err := p.client.CoreV1().PersistentVolumeClaims(options.PVC.Namespace).Get(sourcePVCName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting source PVC %s/%s: %v", options.PVC.Namespace, sourcePVCName, err)
+	}
+	if sourcePVC.Status.Phase != v1.ClaimBound {
+		return nil, fmt.Errorf("source PVC %s/%s is not Bound", options.PVC.Namespace, sourcePVCName)
+	}
+
+	sourcePV, err := p.client.CoreV1().PersistentVolumes().Get(sourcePVC.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting PV %s backing source PVC %s/%s: %v", sourcePVC.Spec.VolumeName, options.PVC.Namespace, sourcePVCName, err)
+	}
+	if sourcePV.Spec.CSI == nil || sourcePV.Spec.CSI.Driver != DriverName {
+		return nil, fmt.Errorf("source PVC %s/%s is not backed by driver %s", options.PVC.Namespace, sourcePVCName, DriverName)
+	}
+
+	requestedCapacity := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	sourceCapacity := sourcePVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	if requestedCapacity.Value() < sourceCapacity.Value() {
+		return nil, fmt.Errorf("requested volume size %d is less than the size %d of source PVC %s/%s", requestedCapacity.Value(), sourceCapacity.Value(), options.PVC.Namespace, sourcePVCName)
+	}
+	if requestedCapacity.Value() > sourceCapacity.Value() {
+		glog.Warningf("requested volume size %d is greater than the size %d of source PVC %s/%s. Volume plugin needs to handle volume expansion.", requestedCapacity.Value(), sourceCapacity.Value(), options.PVC.Namespace, sourcePVCName)
+	}
+
+	volumeContentSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{
+				Id: p.volumeHandleToId(sourcePV.Spec.CSI.VolumeHandle),
+			},
+		},
+	}
+
+	return volumeContentSource, nil
+}
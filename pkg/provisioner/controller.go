@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -20,6 +21,8 @@ import (
 	snapapi "github.com/kubernetes-csi/external-snapshotter/pkg/apis/volumesnapshot/v1alpha1"
 	snapclientset "github.com/kubernetes-csi/external-snapshotter/pkg/client/clientset/versioned"
 
+	"github.com/dearcode/csi-lvm/pkg/client/groupsnapshot"
+
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -35,23 +38,36 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	csiclientset "k8s.io/csi-api/pkg/client/clientset/versioned"
-
-	"github.com/kubernetes-csi/external-provisioner/pkg/features"
-	utilfeature "k8s.io/apiserver/pkg/util/feature"
 )
 
 const (
-	provisionerSecretNameKey      = "csiProvisionerSecretName"
-	provisionerSecretNamespaceKey = "csiProvisionerSecretNamespace"
-
-	controllerPublishSecretNameKey      = "csiControllerPublishSecretName"
-	controllerPublishSecretNamespaceKey = "csiControllerPublishSecretNamespace"
-
-	nodeStageSecretNameKey      = "csiNodeStageSecretName"
-	nodeStageSecretNamespaceKey = "csiNodeStageSecretNamespace"
-
-	nodePublishSecretNameKey      = "csiNodePublishSecretName"
-	nodePublishSecretNamespaceKey = "csiNodePublishSecretNamespace"
+	// reservedPrefixKey is the prefix reserved for parameters generated or
+	// consumed internally by the CSI provisioning machinery. StorageClass
+	// parameters carrying this prefix are never forwarded to the CSI driver.
+	reservedPrefixKey = "csi.storage.k8s.io/"
+
+	provisionerSecretNameKey               = "csiProvisionerSecretName"
+	provisionerSecretNamespaceKey          = "csiProvisionerSecretNamespace"
+	prefixedProvisionerSecretNameKey       = reservedPrefixKey + "provisioner-secret-name"
+	prefixedProvisionerSecretNamespaceKey  = reservedPrefixKey + "provisioner-secret-namespace"
+
+	controllerPublishSecretNameKey              = "csiControllerPublishSecretName"
+	controllerPublishSecretNamespaceKey         = "csiControllerPublishSecretNamespace"
+	prefixedControllerPublishSecretNameKey      = reservedPrefixKey + "controller-publish-secret-name"
+	prefixedControllerPublishSecretNamespaceKey = reservedPrefixKey + "controller-publish-secret-namespace"
+
+	nodeStageSecretNameKey              = "csiNodeStageSecretName"
+	nodeStageSecretNamespaceKey         = "csiNodeStageSecretNamespace"
+	prefixedNodeStageSecretNameKey      = reservedPrefixKey + "node-stage-secret-name"
+	prefixedNodeStageSecretNamespaceKey = reservedPrefixKey + "node-stage-secret-namespace"
+
+	nodePublishSecretNameKey              = "csiNodePublishSecretName"
+	nodePublishSecretNamespaceKey         = "csiNodePublishSecretNamespace"
+	prefixedNodePublishSecretNameKey      = reservedPrefixKey + "node-publish-secret-name"
+	prefixedNodePublishSecretNamespaceKey = reservedPrefixKey + "node-publish-secret-namespace"
+
+	fsTypeKey         = "fstype"
+	prefixedFsTypeKey = reservedPrefixKey + "fstype"
 
 	// Defines parameters for ExponentialBackoff used for executing
 	// CSI CreateVolume API call, it gives approx 4 minutes for the CSI
@@ -66,12 +82,74 @@ const (
 	snapshotAPIGroup = snapapi.GroupName // "snapshot.storage.k8s.io"
 )
 
+// deprecatedKeyWarnings tracks which (StorageClass name, legacy key) pairs
+// have already produced a deprecation warning, so that repeated Provision
+// calls against the same StorageClass don't spam the log.
+var (
+	deprecatedKeyWarningsMu sync.Mutex
+	deprecatedKeyWarnings   = sets.NewString()
+)
+
+// prefixedReplacementKey maps each legacy (non-prefixed) StorageClass
+// parameter key to the csi.storage.k8s.io/-prefixed key that replaces it, so
+// that warnOnceForDeprecatedKey can point users at the exact key to use.
+var prefixedReplacementKey = map[string]string{
+	provisionerSecretNameKey:       prefixedProvisionerSecretNameKey,
+	controllerPublishSecretNameKey: prefixedControllerPublishSecretNameKey,
+	nodeStageSecretNameKey:         prefixedNodeStageSecretNameKey,
+	nodePublishSecretNameKey:       prefixedNodePublishSecretNameKey,
+	snapshotterSecretNameKey:       prefixedSnapshotterSecretNameKey,
+	fsTypeKey:                      prefixedFsTypeKey,
+}
+
+// warnOnceForDeprecatedKey logs a deprecation warning for a legacy
+// (non-prefixed) StorageClass parameter key the first time it is seen for a
+// given StorageClass.
+func warnOnceForDeprecatedKey(storageClassName, legacyKey string) {
+	deprecatedKeyWarningsMu.Lock()
+	defer deprecatedKeyWarningsMu.Unlock()
+	id := storageClassName + "/" + legacyKey
+	if deprecatedKeyWarnings.Has(id) {
+		return
+	}
+	deprecatedKeyWarnings.Insert(id)
+	replacement, ok := prefixedReplacementKey[legacyKey]
+	if !ok {
+		replacement = reservedPrefixKey + legacyKey
+	}
+	glog.Warningf("StorageClass %q uses deprecated parameter %q, please use %q instead", storageClassName, legacyKey, replacement)
+}
+
+// isReservedStorageClassParameter returns true if key is one of the
+// csi.storage.k8s.io/-prefixed parameters consumed internally by the
+// provisioner and must not be forwarded to the CSI driver.
+func isReservedStorageClassParameter(key string) bool {
+	return strings.HasPrefix(key, reservedPrefixKey)
+}
+
+// stripReservedStorageClassParameters returns a copy of params with every
+// csi.storage.k8s.io/-prefixed key removed.
+func stripReservedStorageClassParameters(params map[string]string) map[string]string {
+	stripped := make(map[string]string, len(params))
+	for k, v := range params {
+		if isReservedStorageClassParameter(k) {
+			continue
+		}
+		stripped[k] = v
+	}
+	return stripped
+}
+
 // CSIProvisioner struct
 type csiProvisioner struct {
 	client               kubernetes.Interface
 	csiClient            csi.ControllerClient
+	identityClient       csi.IdentityClient
 	csiAPIClient         csiclientset.Interface
 	snapshotClient       snapclientset.Interface
+	groupSnapshotClient  groupsnapshot.Interface
+	supportsClone        bool
+	supportsTopology     bool
 	timeout              time.Duration
 	identity             string
 	volumeNamePrefix     string
@@ -102,14 +180,31 @@ func NewCSIProvisioner(client kubernetes.Interface,
 	volumeNamePrefix string,
 	volumeNameUUIDLength int,
 	grpcClient *grpc.ClientConn,
-	snapshotClient snapclientset.Interface) controller.Provisioner {
+	snapshotClient snapclientset.Interface,
+	groupSnapshotClient groupsnapshot.Interface) controller.Provisioner {
 
 	csiClient := csi.NewControllerClient(grpcClient)
+	identityClient := csi.NewIdentityClient(grpcClient)
+
+	supportsClone, err := SupportsControllerClone(csiClient, connectionTimeout)
+	if err != nil {
+		glog.Warningf("error probing CSI driver for CLONE_VOLUME capability, PVC cloning will be disabled: %v", err)
+	}
+
+	supportsTopology, err := SupportsTopology(identityClient, connectionTimeout)
+	if err != nil {
+		glog.Warningf("error probing CSI driver for VOLUME_ACCESSIBILITY_CONSTRAINTS capability, topology-aware provisioning will be disabled: %v", err)
+	}
+
 	provisioner := &csiProvisioner{
 		client:               client,
 		csiClient:            csiClient,
+		identityClient:       identityClient,
 		csiAPIClient:         csiAPIClient,
 		snapshotClient:       snapshotClient,
+		groupSnapshotClient:  groupSnapshotClient,
+		supportsClone:        supportsClone,
+		supportsTopology:     supportsTopology,
 		timeout:              connectionTimeout,
 		identity:             identity,
 		volumeNamePrefix:     volumeNamePrefix,
@@ -143,18 +238,40 @@ func (p *csiProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 	}
 
 	var needSnapshotSupport bool = false
+	var needGroupSnapshotSupport bool = false
+	var needCloneSupport bool = false
 	if options.PVC.Spec.DataSource != nil {
-		// PVC.Spec.DataSource.Name is the name of the VolumeSnapshot API object
+		// PVC.Spec.DataSource.Name is the name of the source API object
 		if options.PVC.Spec.DataSource.Name == "" {
 			return nil, fmt.Errorf("the PVC source not found for PVC %s", options.PVC.Name)
 		}
-		if options.PVC.Spec.DataSource.Kind != snapshotKind {
-			return nil, fmt.Errorf("the PVC source is not the right type. Expected %s, Got %s", snapshotKind, options.PVC.Spec.DataSource.Kind)
-		}
-		if *(options.PVC.Spec.DataSource.APIGroup) != snapshotAPIGroup {
-			return nil, fmt.Errorf("the PVC source does not belong to the right APIGroup. Expected %s, Got %s", snapshotAPIGroup, *(options.PVC.Spec.DataSource.APIGroup))
+		switch options.PVC.Spec.DataSource.Kind {
+		case snapshotKind:
+			apiGroup := ""
+			if options.PVC.Spec.DataSource.APIGroup != nil {
+				apiGroup = *(options.PVC.Spec.DataSource.APIGroup)
+			}
+			if apiGroup != snapshotAPIGroup {
+				return nil, fmt.Errorf("the PVC source does not belong to the right APIGroup. Expected %s, Got %s", snapshotAPIGroup, apiGroup)
+			}
+			needSnapshotSupport = true
+		case groupSnapshotKind:
+			apiGroup := ""
+			if options.PVC.Spec.DataSource.APIGroup != nil {
+				apiGroup = *(options.PVC.Spec.DataSource.APIGroup)
+			}
+			if apiGroup != groupSnapshotAPIGroup {
+				return nil, fmt.Errorf("the PVC source does not belong to the right APIGroup. Expected %s, Got %s", groupSnapshotAPIGroup, apiGroup)
+			}
+			needGroupSnapshotSupport = true
+		case pvcKind:
+			if options.PVC.Spec.DataSource.APIGroup != nil && *(options.PVC.Spec.DataSource.APIGroup) != "" {
+				return nil, fmt.Errorf("the PVC source does not belong to the right APIGroup. Expected the core API group, Got %s", *(options.PVC.Spec.DataSource.APIGroup))
+			}
+			needCloneSupport = true
+		default:
+			return nil, fmt.Errorf("the PVC source is not the right type. Expected %s, %s or %s, Got %s", snapshotKind, groupSnapshotKind, pvcKind, options.PVC.Spec.DataSource.Kind)
 		}
-		needSnapshotSupport = true
 	}
 
 	pvName, err := makeVolumeName(p.volumeNamePrefix, fmt.Sprintf("%s", options.PVC.ObjectMeta.UID), p.volumeNameUUIDLength)
@@ -196,7 +313,7 @@ func (p *csiProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 	// Create a CSI CreateVolumeRequest and Response
 	req := csi.CreateVolumeRequest{
 		Name:               pvName,
-		Parameters:         options.Parameters,
+		Parameters:         stripReservedStorageClassParameters(options.Parameters),
 		VolumeCapabilities: volumeCaps,
 		CapacityRange: &csi.CapacityRange{
 			RequiredBytes: int64(volSizeBytes),
@@ -211,13 +328,41 @@ func (p *csiProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 		req.VolumeContentSource = volumeContentSource
 	}
 
+	if needGroupSnapshotSupport {
+		volumeContentSource, err := p.getVolumeContentSourceFromGroupSnapshot(options)
+		if err != nil {
+			return nil, fmt.Errorf("error getting snapshot handle from VolumeGroupSnapshot %s: %v", options.PVC.Spec.DataSource.Name, err)
+		}
+		req.VolumeContentSource = volumeContentSource
+	}
+
+	if needCloneSupport {
+		volumeContentSource, err := p.getVolumeContentSourceFromPVC(options)
+		if err != nil {
+			return nil, fmt.Errorf("error getting volume handle for clone source PVC %s: %v", options.PVC.Spec.DataSource.Name, err)
+		}
+		req.VolumeContentSource = volumeContentSource
+	}
+
+	accessibilityRequirements, err := p.getAccessibilityRequirements(options)
+	if err != nil {
+		return nil, fmt.Errorf("error getting accessibility requirements for PVC %s: %v", options.PVC.Name, err)
+	}
+	req.AccessibilityRequirements = accessibilityRequirements
+
 	glog.V(5).Infof("CreateVolumeRequest %+v", req)
 
 	rep := &csi.CreateVolumeResponse{}
 
+	storageClassName := options.PVC.Spec.StorageClassName
+	scName := ""
+	if storageClassName != nil {
+		scName = *storageClassName
+	}
+
 	// Resolve provision secret credentials.
 	// No PVC is provided when resolving provision/delete secret names, since the PVC may or may not exist at delete time.
-	provisionerSecretRef, err := getSecretReference(provisionerSecretNameKey, provisionerSecretNamespaceKey, options.Parameters, pvName, nil)
+	provisionerSecretRef, err := getSecretReference(provisionerSecretNameKey, provisionerSecretNamespaceKey, prefixedProvisionerSecretNameKey, prefixedProvisionerSecretNamespaceKey, scName, options.Parameters, pvName, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -228,15 +373,15 @@ func (p *csiProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 	req.ControllerCreateSecrets = provisionerCredentials
 
 	// Resolve controller publish, node stage, node publish secret references
-	controllerPublishSecretRef, err := getSecretReference(controllerPublishSecretNameKey, controllerPublishSecretNamespaceKey, options.Parameters, pvName, options.PVC)
+	controllerPublishSecretRef, err := getSecretReference(controllerPublishSecretNameKey, controllerPublishSecretNamespaceKey, prefixedControllerPublishSecretNameKey, prefixedControllerPublishSecretNamespaceKey, scName, options.Parameters, pvName, options.PVC)
 	if err != nil {
 		return nil, err
 	}
-	nodeStageSecretRef, err := getSecretReference(nodeStageSecretNameKey, nodeStageSecretNamespaceKey, options.Parameters, pvName, options.PVC)
+	nodeStageSecretRef, err := getSecretReference(nodeStageSecretNameKey, nodeStageSecretNamespaceKey, prefixedNodeStageSecretNameKey, prefixedNodeStageSecretNamespaceKey, scName, options.Parameters, pvName, options.PVC)
 	if err != nil {
 		return nil, err
 	}
-	nodePublishSecretRef, err := getSecretReference(nodePublishSecretNameKey, nodePublishSecretNamespaceKey, options.Parameters, pvName, options.PVC)
+	nodePublishSecretRef, err := getSecretReference(nodePublishSecretNameKey, nodePublishSecretNamespaceKey, prefixedNodePublishSecretNameKey, prefixedNodePublishSecretNamespaceKey, scName, options.Parameters, pvName, options.PVC)
 	if err != nil {
 		return nil, err
 	}
@@ -290,10 +435,15 @@ func (p *csiProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 	}
 
 	fsType := ""
-	for k, v := range options.Parameters {
-		switch strings.ToLower(k) {
-		case "fstype":
-			fsType = v
+	if v, ok := options.Parameters[prefixedFsTypeKey]; ok {
+		fsType = v
+	} else {
+		for k, v := range options.Parameters {
+			switch strings.ToLower(k) {
+			case fsTypeKey:
+				warnOnceForDeprecatedKey(scName, fsTypeKey)
+				fsType = v
+			}
 		}
 	}
 	if len(fsType) == 0 {
@@ -325,6 +475,10 @@ func (p *csiProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 		},
 	}
 
+	if nodeAffinity := pvNodeAffinityFromTopology(rep.Volume.AccessibleTopology); nodeAffinity != nil {
+		pv.Spec.NodeAffinity = nodeAffinity
+	}
+
 	glog.Infof("successfully created PV %+v", pv.Spec.PersistentVolumeSource)
 
 	return pv, nil
@@ -412,7 +566,7 @@ func (p *csiProvisioner) Delete(volume *v1.PersistentVolume) error {
 		if storageClass, err := p.client.StorageV1().StorageClasses().Get(storageClassName, metav1.GetOptions{}); err == nil {
 			// Resolve provision secret credentials.
 			// No PVC is provided when resolving provision/delete secret names, since the PVC may or may not exist at delete time.
-			provisionerSecretRef, err := getSecretReference(provisionerSecretNameKey, provisionerSecretNamespaceKey, storageClass.Parameters, volume.Name, nil)
+			provisionerSecretRef, err := getSecretReference(provisionerSecretNameKey, provisionerSecretNamespaceKey, prefixedProvisionerSecretNameKey, prefixedProvisionerSecretNamespaceKey, storageClassName, storageClass.Parameters, volume.Name, nil)
 			if err != nil {
 				return err
 			}
@@ -460,10 +614,24 @@ func (p *csiProvisioner) volumeHandleToId(handle string) string {
 // - the name or namespace parameter contains a token that cannot be resolved
 // - the resolved name is not a valid secret name
 // - the resolved namespace is not a valid namespace name
-func getSecretReference(nameKey, namespaceKey string, storageClassParams map[string]string, pvName string, pvc *v1.PersistentVolumeClaim) (*v1.SecretReference, error) {
+func getSecretReference(nameKey, namespaceKey, prefixedNameKey, prefixedNamespaceKey, storageClassName string, storageClassParams map[string]string, pvName string, pvc *v1.PersistentVolumeClaim) (*v1.SecretReference, error) {
 	nameTemplate, hasName := storageClassParams[nameKey]
 	namespaceTemplate, hasNamespace := storageClassParams[namespaceKey]
 
+	prefixedNameTemplate, hasPrefixedName := storageClassParams[prefixedNameKey]
+	prefixedNamespaceTemplate, hasPrefixedNamespace := storageClassParams[prefixedNamespaceKey]
+
+	if (hasName || hasNamespace) && (hasPrefixedName || hasPrefixedNamespace) {
+		return nil, fmt.Errorf("only one of %q/%q or %q/%q may be specified", nameKey, namespaceKey, prefixedNameKey, prefixedNamespaceKey)
+	}
+
+	if hasPrefixedName || hasPrefixedNamespace {
+		nameTemplate, hasName = prefixedNameTemplate, hasPrefixedName
+		namespaceTemplate, hasNamespace = prefixedNamespaceTemplate, hasPrefixedNamespace
+	} else if hasName || hasNamespace {
+		warnOnceForDeprecatedKey(storageClassName, nameKey)
+	}
+
 	if !hasName && !hasNamespace {
 		return nil, nil
 	}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestGetSecretReferenceRejectsOldAndNewKeysTogether(t *testing.T) {
+	params := map[string]string{
+		provisionerSecretNameKey:         "legacy-secret",
+		provisionerSecretNamespaceKey:    "legacy-ns",
+		prefixedProvisionerSecretNameKey: "prefixed-secret",
+	}
+	_, err := getSecretReference(provisionerSecretNameKey, provisionerSecretNamespaceKey, prefixedProvisionerSecretNameKey, prefixedProvisionerSecretNamespaceKey, "my-sc", params, "pv-1", nil)
+	if err == nil {
+		t.Fatal("expected error when both legacy and prefixed secret keys are specified, got nil")
+	}
+}
+
+func TestGetSecretReferenceLegacyKeysStillWork(t *testing.T) {
+	params := map[string]string{
+		provisionerSecretNameKey:      "legacy-secret",
+		provisionerSecretNamespaceKey: "legacy-ns",
+	}
+	ref, err := getSecretReference(provisionerSecretNameKey, provisionerSecretNamespaceKey, prefixedProvisionerSecretNameKey, prefixedProvisionerSecretNamespaceKey, "my-sc", params, "pv-1", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ref.Name != "legacy-secret" || ref.Namespace != "legacy-ns" {
+		t.Fatalf("unexpected secret reference: %+v", ref)
+	}
+}
+
+func TestGetSecretReferencePrefixedKeysAndTemplateResolution(t *testing.T) {
+	params := map[string]string{
+		prefixedProvisionerSecretNameKey:      "${pvc.name}-secret",
+		prefixedProvisionerSecretNamespaceKey: "${pvc.namespace}",
+	}
+	pvc := &v1.PersistentVolumeClaim{}
+	pvc.Name = "my-claim"
+	pvc.Namespace = "my-ns"
+
+	ref, err := getSecretReference(provisionerSecretNameKey, provisionerSecretNamespaceKey, prefixedProvisionerSecretNameKey, prefixedProvisionerSecretNamespaceKey, "my-sc", params, "pv-1", pvc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ref.Name != "my-claim-secret" {
+		t.Errorf("expected resolved name %q, got %q", "my-claim-secret", ref.Name)
+	}
+	if ref.Namespace != "my-ns" {
+		t.Errorf("expected resolved namespace %q, got %q", "my-ns", ref.Namespace)
+	}
+}
+
+func TestStripReservedStorageClassParameters(t *testing.T) {
+	params := map[string]string{
+		"type":                                "ssd",
+		prefixedFsTypeKey:                     "ext4",
+		prefixedProvisionerSecretNameKey:      "secret",
+		prefixedProvisionerSecretNamespaceKey: "ns",
+	}
+	stripped := stripReservedStorageClassParameters(params)
+	if _, ok := stripped["type"]; !ok {
+		t.Errorf("expected non-reserved parameter %q to survive stripping", "type")
+	}
+	for k := range stripped {
+		if isReservedStorageClassParameter(k) {
+			t.Errorf("reserved parameter %q was not stripped", k)
+		}
+	}
+	if len(stripped) != 1 {
+		t.Errorf("expected 1 surviving parameter, got %d: %+v", len(stripped), stripped)
+	}
+}
+
+func TestWarnOnceForDeprecatedKeyUsesPrefixedReplacement(t *testing.T) {
+	replacement, ok := prefixedReplacementKey[provisionerSecretNameKey]
+	if !ok {
+		t.Fatalf("no replacement registered for %q", provisionerSecretNameKey)
+	}
+	if replacement != prefixedProvisionerSecretNameKey {
+		t.Errorf("expected replacement %q, got %q", prefixedProvisionerSecretNameKey, replacement)
+	}
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"fmt"
+
+	groupsnapshotapi "github.com/dearcode/csi-lvm/pkg/apis/groupsnapshot/v1alpha1"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+const (
+	groupSnapshotKind     = groupsnapshotapi.VolumeGroupSnapshotKind
+	groupSnapshotAPIGroup = groupsnapshotapi.GroupName
+
+	// sourcePVCNameAnnotation records, on the PVC being provisioned, which
+	// member of a VolumeGroupSnapshot it should be restored from.
+	sourcePVCNameAnnotation = reservedPrefixKey + "source-pvc-name"
+)
+
+// getVolumeContentSourceFromGroupSnapshot resolves the CSI snapshot handle
+// to restore from when options.PVC.Spec.DataSource references a
+// VolumeGroupSnapshot. It locates the member of the group matching the
+// PVC named by the sourcePVCNameAnnotation annotation, and validates that
+// member's VolumeSnapshotContent with the binding checks
+// getVolumeContentSource applies to a plain VolumeSnapshot (not being
+// deleted, bound to the expected VolumeSnapshot, CSI source set).
+// Readiness is checked on the group as a whole, and the requested capacity
+// is not compared against the member's restore size.
+func (p *csiProvisioner) getVolumeContentSourceFromGroupSnapshot(options controller.VolumeOptions) (*csi.VolumeContentSource, error) {
+	groupSnapshotName := options.PVC.Spec.DataSource.Name
+	sourcePVCName, ok := options.PVC.Annotations[sourcePVCNameAnnotation]
+	if !ok || sourcePVCName == "" {
+		return nil, fmt.Errorf("PVC %s requests restore from VolumeGroupSnapshot %s but is missing the %s annotation", options.PVC.Name, groupSnapshotName, sourcePVCNameAnnotation)
+	}
+
+	groupSnapshot, err := p.groupSnapshotClient.GroupsnapshotV1alpha1().VolumeGroupSnapshots(options.PVC.Namespace).Get(groupSnapshotName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting VolumeGroupSnapshot %s from api server: %v", groupSnapshotName, err)
+	}
+	if !groupSnapshot.Status.ReadyToUse {
+		return nil, fmt.Errorf("VolumeGroupSnapshot %s is not ReadyToUse", groupSnapshotName)
+	}
+
+	var member *groupsnapshotapi.PVPVCMapping
+	for i := range groupSnapshot.Status.Members {
+		if groupSnapshot.Status.Members[i].PersistentVolumeClaimName == sourcePVCName {
+			member = &groupSnapshot.Status.Members[i]
+			break
+		}
+	}
+	if member == nil {
+		return nil, fmt.Errorf("VolumeGroupSnapshot %s has no member for source PVC %s", groupSnapshotName, sourcePVCName)
+	}
+
+	snapContentObj, err := p.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshotContents().Get(member.VolumeSnapshotContentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting snapshotcontent %s for member %s of VolumeGroupSnapshot %s: %v", member.VolumeSnapshotContentName, sourcePVCName, groupSnapshotName, err)
+	}
+	if snapContentObj.ObjectMeta.DeletionTimestamp != nil {
+		return nil, fmt.Errorf("snapshotcontent %s for member %s of VolumeGroupSnapshot %s is currently being deleted", member.VolumeSnapshotContentName, sourcePVCName, groupSnapshotName)
+	}
+	if snapContentObj.Spec.VolumeSnapshotRef == nil {
+		return nil, fmt.Errorf("member %s of VolumeGroupSnapshot %s is not bound or invalid", sourcePVCName, groupSnapshotName)
+	}
+	if snapContentObj.Spec.VolumeSnapshotRef.UID != member.VolumeSnapshotUID || snapContentObj.Spec.VolumeSnapshotRef.Namespace != member.VolumeSnapshotNamespace || snapContentObj.Spec.VolumeSnapshotRef.Name != member.VolumeSnapshotName {
+		return nil, fmt.Errorf("snapshotcontent %s for member %s of VolumeGroupSnapshot %s is bound to a different VolumeSnapshot", member.VolumeSnapshotContentName, sourcePVCName, groupSnapshotName)
+	}
+	if snapContentObj.Spec.VolumeSnapshotSource.CSI == nil {
+		return nil, fmt.Errorf("member %s of VolumeGroupSnapshot %s is not bound or invalid", sourcePVCName, groupSnapshotName)
+	}
+
+	glog.V(5).Infof("VolumeGroupSnapshot %s member %s resolved to snapshotcontent %+v", groupSnapshotName, sourcePVCName, snapContentObj)
+
+	volumeContentSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				Id: snapContentObj.Spec.VolumeSnapshotSource.CSI.SnapshotHandle,
+			},
+		},
+	}
+
+	return volumeContentSource, nil
+}
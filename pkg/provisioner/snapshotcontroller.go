@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	snapapi "github.com/kubernetes-csi/external-snapshotter/pkg/apis/volumesnapshot/v1alpha1"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// snapshotContentFinalizer is placed on every VolumeSnapshotContent this
+// provisioner creates, so that deleting it goes through syncContent (which
+// issues the CSI DeleteSnapshot call) before the object is actually
+// removed from the API server, the same way Kubernetes itself uses
+// kubernetes.io/pvc-protection to sequence PVC deletion behind unmounting.
+const snapshotContentFinalizer = reservedPrefixKey + "snapshotter-protection"
+
+// SnapshotController watches VolumeSnapshot and VolumeSnapshotContent
+// objects and drives csiProvisioner.CreateSnapshot/DeleteSnapshot to bring
+// the cluster's snapshot state in line with what's requested. It mirrors
+// the informer/workqueue shape of pkg/attacher.CSIAttachController: one
+// queue (and rate limiter) per watched kind, fed by informer event
+// handlers and drained by worker goroutines calling a per-kind sync
+// function.
+type SnapshotController struct {
+	provisioner *csiProvisioner
+	resync      time.Duration
+
+	snapshotInformer cache.SharedIndexInformer
+	contentInformer  cache.SharedIndexInformer
+
+	snapshotQueue workqueue.RateLimitingInterface
+	contentQueue  workqueue.RateLimitingInterface
+}
+
+// NewSnapshotController creates a new SnapshotController for provisioner.
+// resync bounds how often every known VolumeSnapshot/VolumeSnapshotContent
+// is re-synced even without a triggering event, same as the
+// SharedInformerFactory resync period used by cmd/attacher.
+func NewSnapshotController(provisioner *csiProvisioner, resync time.Duration) *SnapshotController {
+	ctrl := &SnapshotController{
+		provisioner: provisioner,
+		resync:      resync,
+		snapshotQueue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(backoffDuration, backoffDuration*time.Duration(backoffSteps)), "csi-snapshotter-snapshot"),
+		contentQueue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(backoffDuration, backoffDuration*time.Duration(backoffSteps)), "csi-snapshotter-content"),
+	}
+
+	ctrl.snapshotInformer = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshots(v1.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshots(v1.NamespaceAll).Watch(options)
+			},
+		},
+		&snapapi.VolumeSnapshot{}, resync, cache.Indexers{},
+	)
+	ctrl.contentInformer = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshotContents().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshotContents().Watch(options)
+			},
+		},
+		&snapapi.VolumeSnapshotContent{}, resync, cache.Indexers{},
+	)
+
+	ctrl.snapshotInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.enqueueSnapshot,
+		UpdateFunc: func(old, new interface{}) { ctrl.enqueueSnapshot(new) },
+	})
+	ctrl.contentInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.enqueueContent,
+		UpdateFunc: func(old, new interface{}) { ctrl.enqueueContent(new) },
+	})
+
+	return ctrl
+}
+
+func (ctrl *SnapshotController) enqueueSnapshot(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("failed to get key for VolumeSnapshot: %v", err)
+		return
+	}
+	ctrl.snapshotQueue.Add(key)
+}
+
+func (ctrl *SnapshotController) enqueueContent(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("failed to get key for VolumeSnapshotContent: %v", err)
+		return
+	}
+	ctrl.contentQueue.Add(key)
+}
+
+// Run starts threads worker goroutines processing the VolumeSnapshot and
+// VolumeSnapshotContent workqueues, until stopCh is closed.
+func (ctrl *SnapshotController) Run(threads int, stopCh <-chan struct{}) {
+	defer ctrl.snapshotQueue.ShutDown()
+	defer ctrl.contentQueue.ShutDown()
+
+	glog.Infof("Starting CSI snapshotter for driver %s", DriverName)
+	defer glog.Infof("Shutting down CSI snapshotter for driver %s", DriverName)
+
+	go ctrl.snapshotInformer.Run(stopCh)
+	go ctrl.contentInformer.Run(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, ctrl.snapshotInformer.HasSynced, ctrl.contentInformer.HasSynced) {
+		return
+	}
+
+	for i := 0; i < threads; i++ {
+		go wait.Until(ctrl.snapshotWorker, time.Second, stopCh)
+		go wait.Until(ctrl.contentWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+}
+
+func (ctrl *SnapshotController) snapshotWorker() {
+	for ctrl.processNextSnapshot() {
+	}
+}
+
+func (ctrl *SnapshotController) contentWorker() {
+	for ctrl.processNextContent() {
+	}
+}
+
+func (ctrl *SnapshotController) processNextSnapshot() bool {
+	key, shutdown := ctrl.snapshotQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer ctrl.snapshotQueue.Done(key)
+
+	if err := ctrl.syncSnapshot(key.(string)); err != nil {
+		glog.Warningf("error syncing VolumeSnapshot %q, will retry: %v", key, err)
+		ctrl.snapshotQueue.AddRateLimited(key)
+		return true
+	}
+	ctrl.snapshotQueue.Forget(key)
+	return true
+}
+
+func (ctrl *SnapshotController) processNextContent() bool {
+	key, shutdown := ctrl.contentQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer ctrl.contentQueue.Done(key)
+
+	if err := ctrl.syncContent(key.(string)); err != nil {
+		glog.Warningf("error syncing VolumeSnapshotContent %q, will retry: %v", key, err)
+		ctrl.contentQueue.AddRateLimited(key)
+		return true
+	}
+	ctrl.contentQueue.Forget(key)
+	return true
+}
+
+// syncSnapshot drives a VolumeSnapshot towards having a bound
+// VolumeSnapshotContent. A VolumeSnapshot that already names a
+// SnapshotContentName is considered already provisioned (or in the
+// process of being restored from, see getVolumeContentSource) and is
+// left alone.
+func (ctrl *SnapshotController) syncSnapshot(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	obj, exists, err := ctrl.snapshotInformer.GetStore().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	snapshot := obj.(*snapapi.VolumeSnapshot)
+
+	if snapshot.DeletionTimestamp != nil {
+		return nil
+	}
+	if snapshot.Spec.SnapshotContentName != "" {
+		return nil
+	}
+	if snapshot.Spec.Source == nil || snapshot.Spec.Source.Kind != "PersistentVolumeClaim" {
+		return nil
+	}
+
+	pvc, err := ctrl.provisioner.client.CoreV1().PersistentVolumeClaims(namespace).Get(snapshot.Spec.Source.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pvc.Status.Phase != v1.ClaimBound {
+		glog.V(4).Infof("VolumeSnapshot %s/%s source PVC %s is not yet Bound, will retry", namespace, name, snapshot.Spec.Source.Name)
+		return nil
+	}
+
+	pv, err := ctrl.provisioner.client.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName {
+		glog.V(4).Infof("VolumeSnapshot %s/%s source PV %s is not backed by driver %s, ignoring", namespace, name, pv.Name, DriverName)
+		return nil
+	}
+
+	contentName := name + "-" + string(snapshot.UID)
+
+	// CreateSnapshot, the content Create and the snapshot Update below are
+	// three separate steps against two different APIs, so a crash or
+	// transient error between them must not turn into an infinite retry
+	// loop: re-issuing content Create after it already succeeded would
+	// just return AlreadyExists forever. Check for that content by its
+	// deterministic name first and, if it's already there, skip straight
+	// to binding the snapshot.
+	if _, err := ctrl.provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshotContents().Get(contentName, metav1.GetOptions{}); err == nil {
+		snapshot = snapshot.DeepCopy()
+		snapshot.Spec.SnapshotContentName = contentName
+		if _, err := ctrl.provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshots(namespace).Update(snapshot); err != nil {
+			return err
+		}
+		glog.V(3).Infof("VolumeSnapshot %s/%s bound to existing VolumeSnapshotContent %s", namespace, name, contentName)
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	snapshot = snapshot.DeepCopy()
+	snapshot.Spec.SnapshotContentName = contentName
+
+	content, err := ctrl.provisioner.CreateSnapshot(snapshot, pv)
+	if err != nil {
+		return err
+	}
+	content.Finalizers = append(content.Finalizers, snapshotContentFinalizer)
+
+	if _, err := ctrl.provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshotContents().Create(content); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	if _, err := ctrl.provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshots(namespace).Update(snapshot); err != nil {
+		return err
+	}
+
+	glog.V(3).Infof("VolumeSnapshot %s/%s bound to VolumeSnapshotContent %s", namespace, name, content.Name)
+	return nil
+}
+
+// syncContent deletes the CSI snapshot backing a VolumeSnapshotContent
+// once it has been marked for deletion, then clears
+// snapshotContentFinalizer so the object can actually be removed. A
+// content with no DeletionTimestamp, or one this provisioner didn't
+// create (no snapshotContentFinalizer), is left alone.
+func (ctrl *SnapshotController) syncContent(key string) error {
+	obj, exists, err := ctrl.contentInformer.GetStore().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	content := obj.(*snapapi.VolumeSnapshotContent)
+
+	if content.DeletionTimestamp == nil {
+		return nil
+	}
+	finalizers := sets.NewString(content.Finalizers...)
+	if !finalizers.Has(snapshotContentFinalizer) {
+		return nil
+	}
+
+	if err := ctrl.provisioner.DeleteSnapshot(content); err != nil {
+		return err
+	}
+
+	content = content.DeepCopy()
+	finalizers.Delete(snapshotContentFinalizer)
+	content.Finalizers = finalizers.List()
+	_, err = ctrl.provisioner.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshotContents().Update(content)
+	return err
+}
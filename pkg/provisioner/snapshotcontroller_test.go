@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"testing"
+
+	snapapi "github.com/kubernetes-csi/external-snapshotter/pkg/apis/volumesnapshot/v1alpha1"
+	snapfake "github.com/kubernetes-csi/external-snapshotter/pkg/client/clientset/versioned/fake"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newSnapshotControllerForTest(objects ...runtime.Object) *SnapshotController {
+	p := &csiProvisioner{
+		client:         fake.NewSimpleClientset(),
+		snapshotClient: snapfake.NewSimpleClientset(objects...),
+	}
+	return NewSnapshotController(p, 0)
+}
+
+func TestSyncContentIgnoresContentWithNoDeletionTimestamp(t *testing.T) {
+	content := &snapapi.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "content-1", Finalizers: []string{snapshotContentFinalizer}},
+	}
+	ctrl := newSnapshotControllerForTest(content)
+	ctrl.contentInformer.GetStore().Add(content)
+
+	if err := ctrl.syncContent("content-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSyncSnapshotBindsToExistingContentWithoutRecreating(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: DriverName},
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: "ns", Name: "pvc-1"},
+		},
+	}
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pvc-1"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+		Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+	}
+	snapshot := &snapapi.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "snap-1", UID: "uid-1"},
+		Spec: snapapi.VolumeSnapshotSpec{
+			Source: &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "pvc-1"},
+		},
+	}
+	contentName := "snap-1-uid-1"
+	content := &snapapi.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: contentName},
+	}
+
+	p := &csiProvisioner{
+		client:         fake.NewSimpleClientset(pv, pvc),
+		snapshotClient: snapfake.NewSimpleClientset(snapshot, content),
+	}
+	ctrl := NewSnapshotController(p, 0)
+	ctrl.snapshotInformer.GetStore().Add(snapshot)
+
+	if err := ctrl.syncSnapshot("ns/snap-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated, err := p.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshots("ns").Get("snap-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error fetching snapshot: %v", err)
+	}
+	if updated.Spec.SnapshotContentName != contentName {
+		t.Fatalf("expected snapshot to be bound to %q, got %q", contentName, updated.Spec.SnapshotContentName)
+	}
+}
+
+func TestSyncContentIgnoresContentWithoutFinalizer(t *testing.T) {
+	now := metav1.Now()
+	content := &snapapi.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "content-2", DeletionTimestamp: &now},
+	}
+	ctrl := newSnapshotControllerForTest(content)
+	ctrl.contentInformer.GetStore().Add(content)
+
+	if err := ctrl.syncContent("content-2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
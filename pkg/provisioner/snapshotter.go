@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+
+	snapapi "github.com/kubernetes-csi/external-snapshotter/pkg/apis/volumesnapshot/v1alpha1"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+const (
+	snapshotterSecretNameKey      = "csiSnapshotterSecretName"
+	snapshotterSecretNamespaceKey = "csiSnapshotterSecretNamespace"
+
+	prefixedSnapshotterSecretNameKey      = reservedPrefixKey + "snapshotter-secret-name"
+	prefixedSnapshotterSecretNamespaceKey = reservedPrefixKey + "snapshotter-secret-namespace"
+
+	// isDefaultSnapshotClassLabelKey marks the VolumeSnapshotClass to use
+	// for a given driver when the VolumeSnapshot doesn't name one
+	// explicitly.
+	isDefaultSnapshotClassLabelKey = "snapshot.storage.kubernetes.io/is-default-class"
+)
+
+// getSnapshotClass resolves the VolumeSnapshotClass to use for driver. If
+// requested is non-empty it is used as-is, otherwise the single
+// VolumeSnapshotClass for driver labeled
+// snapshot.storage.kubernetes.io/is-default-class=true is used. It is an
+// error for more than one VolumeSnapshotClass for the same driver to carry
+// that label.
+func (p *csiProvisioner) getSnapshotClass(driver, requested string) (*snapapi.VolumeSnapshotClass, error) {
+	if requested != "" {
+		return p.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshotClasses().Get(requested, metav1.GetOptions{})
+	}
+
+	list, err := p.snapshotClient.VolumesnapshotV1alpha1().VolumeSnapshotClasses().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing VolumeSnapshotClasses: %v", err)
+	}
+
+	var defaultClass *snapapi.VolumeSnapshotClass
+	for i := range list.Items {
+		class := &list.Items[i]
+		if class.Snapshotter != driver {
+			continue
+		}
+		if class.Labels[isDefaultSnapshotClassLabelKey] != "true" {
+			continue
+		}
+		if defaultClass != nil {
+			return nil, fmt.Errorf("multiple VolumeSnapshotClasses (%s, %s) are labeled %s=true for driver %s", defaultClass.Name, class.Name, isDefaultSnapshotClassLabelKey, driver)
+		}
+		defaultClass = class
+	}
+	if defaultClass == nil {
+		return nil, fmt.Errorf("no VolumeSnapshotClass is labeled %s=true for driver %s, and none was requested", isDefaultSnapshotClassLabelKey, driver)
+	}
+	return defaultClass, nil
+}
+
+// CreateSnapshot creates a CSI snapshot backing the given VolumeSnapshot and
+// returns the VolumeSnapshotContent object describing it. The source PV is
+// passed in by the caller (syncSnapshot resolves it from the snapshot's
+// source PVC); it is not looked up here. The VolumeSnapshotClass is
+// resolved via getSnapshotClass, the snapshotter
+// secret (if any) is resolved the same way Provision resolves the
+// provisioner secret, and the CSI call is retried on DeadlineExceeded the
+// same way CreateVolume is.
+func (p *csiProvisioner) CreateSnapshot(snapshot *snapapi.VolumeSnapshot, pv *v1.PersistentVolume) (*snapapi.VolumeSnapshotContent, error) {
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName {
+		return nil, fmt.Errorf("PV %s is not backed by driver %s", pv.Name, DriverName)
+	}
+
+	requested := ""
+	if snapshot.Spec.SnapshotClassName != nil {
+		requested = *snapshot.Spec.SnapshotClassName
+	}
+	class, err := p.getSnapshotClass(DriverName, requested)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving VolumeSnapshotClass for snapshot %s/%s: %v", snapshot.Namespace, snapshot.Name, err)
+	}
+
+	snapshotterSecretRef, err := getSecretReference(snapshotterSecretNameKey, snapshotterSecretNamespaceKey, prefixedSnapshotterSecretNameKey, prefixedSnapshotterSecretNamespaceKey, class.Name, class.Parameters, snapshot.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	snapshotterCredentials, err := getCredentials(p.client, snapshotterSecretRef)
+	if err != nil {
+		return nil, err
+	}
+
+	req := csi.CreateSnapshotRequest{
+		SourceVolumeId:        p.volumeHandleToId(pv.Spec.CSI.VolumeHandle),
+		Name:                  snapshot.Namespace + "-" + snapshot.Name,
+		Parameters:            stripReservedStorageClassParameters(class.Parameters),
+		CreateSnapshotSecrets: snapshotterCredentials,
+	}
+
+	glog.V(5).Infof("CreateSnapshotRequest %+v", req)
+
+	var rep *csi.CreateSnapshotResponse
+	opts := wait.Backoff{Duration: backoffDuration, Factor: backoffFactor, Steps: backoffSteps}
+	err = wait.ExponentialBackoff(opts, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		defer cancel()
+		rep, err = p.csiClient.CreateSnapshot(ctx, &req)
+		if err == nil {
+			return true, nil
+		}
+		if st, ok := status.FromError(err); ok && st.Code() == codes.DeadlineExceeded {
+			glog.Warningf("CreateSnapshot timeout: %s has expired, operation will be retried", p.timeout.String())
+			return false, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	glog.V(3).Infof("create snapshot rep: %+v", *rep.Snapshot)
+
+	restoreSize := resource.NewQuantity(rep.Snapshot.SizeBytes, resource.BinarySI)
+	creationTime := metav1.Unix(rep.Snapshot.CreatedAt, 0)
+	className := class.Name
+
+	content := &snapapi.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: snapshot.Spec.SnapshotContentName,
+		},
+		Spec: snapapi.VolumeSnapshotContentSpec{
+			VolumeSnapshotRef: &v1.ObjectReference{
+				Kind:      "VolumeSnapshot",
+				Namespace: snapshot.Namespace,
+				Name:      snapshot.Name,
+				UID:       snapshot.UID,
+			},
+			PersistentVolumeRef: &v1.ObjectReference{
+				Kind: "PersistentVolume",
+				Name: pv.Name,
+				UID:  pv.UID,
+			},
+			VolumeSnapshotClassName: &className,
+			VolumeSnapshotSource: snapapi.VolumeSnapshotSource{
+				CSI: &snapapi.CSIVolumeSnapshotSource{
+					Driver:         DriverName,
+					SnapshotHandle: rep.Snapshot.Id,
+				},
+			},
+		},
+		Status: snapapi.VolumeSnapshotContentStatus{
+			CreationTime: &creationTime,
+			RestoreSize:  restoreSize,
+			ReadyToUse:   rep.Snapshot.Status != nil && rep.Snapshot.Status.Type == csi.SnapshotStatus_READY,
+		},
+	}
+
+	return content, nil
+}
+
+// DeleteSnapshot deletes the CSI snapshot backing the given
+// VolumeSnapshotContent.
+func (p *csiProvisioner) DeleteSnapshot(content *snapapi.VolumeSnapshotContent) error {
+	if content == nil || content.Spec.VolumeSnapshotSource.CSI == nil {
+		return fmt.Errorf("invalid CSI VolumeSnapshotContent")
+	}
+
+	requested := ""
+	if content.Spec.VolumeSnapshotClassName != nil {
+		requested = *content.Spec.VolumeSnapshotClassName
+	}
+	class, err := p.getSnapshotClass(DriverName, requested)
+	if err != nil {
+		return fmt.Errorf("error resolving VolumeSnapshotClass for snapshotcontent %s: %v", content.Name, err)
+	}
+
+	snapshotterSecretRef, err := getSecretReference(snapshotterSecretNameKey, snapshotterSecretNamespaceKey, prefixedSnapshotterSecretNameKey, prefixedSnapshotterSecretNamespaceKey, class.Name, class.Parameters, content.Name, nil)
+	if err != nil {
+		return err
+	}
+	snapshotterCredentials, err := getCredentials(p.client, snapshotterSecretRef)
+	if err != nil {
+		return err
+	}
+
+	req := csi.DeleteSnapshotRequest{
+		SnapshotId:            content.Spec.VolumeSnapshotSource.CSI.SnapshotHandle,
+		DeleteSnapshotSecrets: snapshotterCredentials,
+	}
+
+	opts := wait.Backoff{Duration: backoffDuration, Factor: backoffFactor, Steps: backoffSteps}
+	return wait.ExponentialBackoff(opts, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		defer cancel()
+		_, err := p.csiClient.DeleteSnapshot(ctx, &req)
+		if err == nil {
+			return true, nil
+		}
+		if st, ok := status.FromError(err); ok && st.Code() == codes.DeadlineExceeded {
+			glog.Warningf("DeleteSnapshot timeout: %s has expired, operation will be retried", p.timeout.String())
+			return false, nil
+		}
+		return false, err
+	})
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	snapapi "github.com/kubernetes-csi/external-snapshotter/pkg/apis/volumesnapshot/v1alpha1"
+	snapfake "github.com/kubernetes-csi/external-snapshotter/pkg/client/clientset/versioned/fake"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newSnapshotClassForTest(name, driver string, isDefault bool) *snapapi.VolumeSnapshotClass {
+	class := &snapapi.VolumeSnapshotClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name},
+		Snapshotter: driver,
+	}
+	if isDefault {
+		class.Labels = map[string]string{isDefaultSnapshotClassLabelKey: "true"}
+	}
+	return class
+}
+
+func TestGetSnapshotClassRequestedIsUsedAsIs(t *testing.T) {
+	p := &csiProvisioner{
+		snapshotClient: snapfake.NewSimpleClientset(newSnapshotClassForTest("explicit-class", DriverName, false)),
+	}
+	class, err := p.getSnapshotClass(DriverName, "explicit-class")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if class.Name != "explicit-class" {
+		t.Errorf("expected class %q, got %q", "explicit-class", class.Name)
+	}
+}
+
+func TestGetSnapshotClassNoDefaultIsError(t *testing.T) {
+	p := &csiProvisioner{
+		snapshotClient: snapfake.NewSimpleClientset(newSnapshotClassForTest("non-default", DriverName, false)),
+	}
+	_, err := p.getSnapshotClass(DriverName, "")
+	if err == nil {
+		t.Fatal("expected error when no VolumeSnapshotClass is labeled default, got nil")
+	}
+}
+
+func TestGetSnapshotClassSingleDefault(t *testing.T) {
+	p := &csiProvisioner{
+		snapshotClient: snapfake.NewSimpleClientset(
+			newSnapshotClassForTest("other-driver-default", "some-other-driver", true),
+			newSnapshotClassForTest("the-default", DriverName, true),
+		),
+	}
+	class, err := p.getSnapshotClass(DriverName, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if class.Name != "the-default" {
+		t.Errorf("expected class %q, got %q", "the-default", class.Name)
+	}
+}
+
+func TestGetSnapshotClassAmbiguousDefaultIsError(t *testing.T) {
+	p := &csiProvisioner{
+		snapshotClient: snapfake.NewSimpleClientset(
+			newSnapshotClassForTest("default-one", DriverName, true),
+			newSnapshotClassForTest("default-two", DriverName, true),
+		),
+	}
+	_, err := p.getSnapshotClass(DriverName, "")
+	if err == nil {
+		t.Fatal("expected error when multiple VolumeSnapshotClasses are labeled default, got nil")
+	}
+	if !strings.Contains(err.Error(), "multiple VolumeSnapshotClasses") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+const (
+	// selectedNodeAnnotation is set by the scheduler on a PVC that uses
+	// WaitForFirstConsumer binding, naming the node the pod (and therefore
+	// the volume) was scheduled to.
+	selectedNodeAnnotation = "volume.kubernetes.io/selected-node"
+)
+
+// SupportsTopology probes the CSI driver's advertised plugin capabilities
+// and reports whether it supports the VOLUME_ACCESSIBILITY_CONSTRAINTS
+// capability. Like SupportsControllerClone, it is meant to be called once
+// at provisioner startup and cached.
+func SupportsTopology(identityClient csi.IdentityClient, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rep, err := identityClient.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		return false, err
+	}
+
+	for _, cap := range rep.GetCapabilities() {
+		if service := cap.GetService(); service != nil && service.GetType() == csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getAccessibilityRequirements builds the CSI AccessibilityRequirements for
+// a CreateVolumeRequest. If the PVC carries the selected-node annotation
+// set by the scheduler for WaitForFirstConsumer binding, that node's
+// topology for DriverName is used as the single requisite/preferred
+// segment. Otherwise options.StorageClass.AllowedTopologies is translated
+// into Requisite segments, shuffled into Preferred. Returns nil, nil if the
+// driver doesn't support topology or there is nothing to plumb.
+func (p *csiProvisioner) getAccessibilityRequirements(options controller.VolumeOptions) (*csi.TopologyRequirement, error) {
+	if !p.supportsTopology {
+		glog.V(4).Infof("CSI driver %s does not advertise VOLUME_ACCESSIBILITY_CONSTRAINTS, skipping topology", DriverName)
+		return nil, nil
+	}
+
+	if selectedNode, ok := options.PVC.Annotations[selectedNodeAnnotation]; ok && selectedNode != "" {
+		segment, err := p.topologyFromNode(selectedNode)
+		if err != nil {
+			return nil, fmt.Errorf("error getting topology for selected node %s: %v", selectedNode, err)
+		}
+		if segment == nil {
+			return nil, nil
+		}
+		topology := &csi.Topology{Segments: segment}
+		return &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{topology},
+			Preferred: []*csi.Topology{topology},
+		}, nil
+	}
+
+	if options.StorageClass == nil || len(options.StorageClass.AllowedTopologies) == 0 {
+		return nil, nil
+	}
+
+	requisite := make([]*csi.Topology, 0)
+	for _, term := range options.StorageClass.AllowedTopologies {
+		for _, segment := range segmentsFromTerm(term) {
+			requisite = append(requisite, &csi.Topology{Segments: segment})
+		}
+	}
+
+	preferred := make([]*csi.Topology, len(requisite))
+	copy(preferred, requisite)
+	rand.Shuffle(len(preferred), func(i, j int) { preferred[i], preferred[j] = preferred[j], preferred[i] })
+
+	return &csi.TopologyRequirement{
+		Requisite: requisite,
+		Preferred: preferred,
+	}, nil
+}
+
+func copySegment(segment map[string]string) map[string]string {
+	out := make(map[string]string, len(segment))
+	for k, v := range segment {
+		out[k] = v
+	}
+	return out
+}
+
+// segmentsFromTerm expands a single AllowedTopologies term into one segment
+// per combination of its MatchLabelExpressions' values: each expression
+// contributes one key, and ANDs across expressions, while the values within
+// a single expression are ORed, producing the cartesian product of all
+// expressions' values as independent segments.
+func segmentsFromTerm(term v1.TopologySelectorTerm) []map[string]string {
+	segments := []map[string]string{{}}
+	for _, exp := range term.MatchLabelExpressions {
+		if len(exp.Values) == 0 {
+			continue
+		}
+		expanded := make([]map[string]string, 0, len(segments)*len(exp.Values))
+		for _, segment := range segments {
+			for _, value := range exp.Values {
+				next := copySegment(segment)
+				next[exp.Key] = value
+				expanded = append(expanded, next)
+			}
+		}
+		segments = expanded
+	}
+	return segments
+}
+
+// topologyFromNode resolves the named Node's topology keys for DriverName,
+// as advertised by its CSINodeInfo object, to a topology segment built from
+// the Node's labels.
+func (p *csiProvisioner) topologyFromNode(nodeName string) (map[string]string, error) {
+	nodeInfo, err := p.csiAPIClient.CsiV1alpha1().CSINodeInfos().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting CSINodeInfo for node %s: %v", nodeName, err)
+	}
+
+	var topologyKeys []string
+	for _, driver := range nodeInfo.Spec.Drivers {
+		if driver.Name == DriverName {
+			topologyKeys = driver.TopologyKeys
+			break
+		}
+	}
+	if len(topologyKeys) == 0 {
+		return nil, nil
+	}
+
+	node, err := p.client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting node %s: %v", nodeName, err)
+	}
+
+	segment := make(map[string]string, len(topologyKeys))
+	for _, key := range topologyKeys {
+		value, ok := node.Labels[key]
+		if !ok {
+			return nil, fmt.Errorf("node %s is missing topology label %s", nodeName, key)
+		}
+		segment[key] = value
+	}
+	return segment, nil
+}
+
+// pvNodeAffinityFromTopology converts the AccessibleTopology returned in a
+// CreateVolumeResponse into the PV NodeAffinity the scheduler uses to bind
+// pods to nodes that can actually reach the volume.
+func pvNodeAffinityFromTopology(topology []*csi.Topology) *v1.VolumeNodeAffinity {
+	if len(topology) == 0 {
+		return nil
+	}
+
+	terms := make([]v1.NodeSelectorTerm, 0, len(topology))
+	for _, t := range topology {
+		if len(t.Segments) == 0 {
+			continue
+		}
+		expressions := make([]v1.NodeSelectorRequirement, 0, len(t.Segments))
+		for k, v := range t.Segments {
+			expressions = append(expressions, v1.NodeSelectorRequirement{
+				Key:      k,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   []string{v},
+			})
+		}
+		terms = append(terms, v1.NodeSelectorTerm{MatchExpressions: expressions})
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+
+	return &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{NodeSelectorTerms: terms},
+	}
+}